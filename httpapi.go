@@ -0,0 +1,175 @@
+package main
+
+import (
+	l "./logger"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+var httpLog = l.New("httpapi")
+
+// Server is the embedded HTTP control-plane: a thin read-only (plus
+// reprocess) view over a Watcher's state, so operators can see stalled
+// granules without tailing logs and an external scheduler can trigger
+// re-runs.
+type Server struct {
+	w    *Watcher
+	addr string
+}
+
+func NewServer(w *Watcher, addr string) *Server {
+	return &Server{w: w, addr: addr}
+}
+
+func (s *Server) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/pipeline", s.handlePipeline)
+	mux.HandleFunc("/groups", s.handleGroups)
+	mux.HandleFunc("/groups/", s.handleGroup)
+	return mux
+}
+
+// ListenAndServe blocks serving the control-plane API; run it in its own
+// goroutine alongside Watcher.Watch.
+func (s *Server) ListenAndServe() error {
+	httpLog.Infof("HTTP control-plane listening on %s", s.addr)
+	return http.ListenAndServe(s.addr, s.mux())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); nil != err {
+		httpLog.Warnf("Failed to encode JSON response: %s", err.Error())
+	}
+}
+
+type pipelineStep struct {
+	Name        string `json:"name"`
+	Command     string `json:"command"`
+	ExecTimeout string `json:"exec_timeout,omitempty"`
+}
+
+type pipelineVar struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+func pipelineSteps() []pipelineStep {
+	steps := make([]pipelineStep, len(pipeline.Steps))
+	for i, st := range pipeline.Steps {
+		steps[i] = pipelineStep{Name: st.Name, Command: st.Command, ExecTimeout: st.ExecTimeout}
+	}
+	return steps
+}
+
+func pipelineVariables() []pipelineVar {
+	vars := make([]pipelineVar, len(pipeline.Variables))
+	for i, v := range pipeline.Variables {
+		vars[i] = pipelineVar{Name: v.Name, Value: v.Value}
+	}
+	return vars
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.w.metrics.WriteProm(w, len(s.w.queue))
+}
+
+func (s *Server) handlePipeline(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Steps     []pipelineStep `json:"steps"`
+		Variables []pipelineVar  `json:"variables"`
+	}{
+		Steps:     pipelineSteps(),
+		Variables: pipelineVariables(),
+	})
+}
+
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	s.w.mu.RLock()
+	defer s.w.mu.RUnlock()
+	groups := make(map[string]*FileGroup, len(s.w.found))
+	for id, grp := range s.w.found {
+		groups[id] = grp
+	}
+	writeJSON(w, groups)
+}
+
+func (s *Server) handleGroup(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/groups/"), "/")
+	id, action := rest, ""
+	if parts := strings.SplitN(rest, "/", 2); 2 == len(parts) {
+		id, action = parts[0], parts[1]
+	}
+
+	if http.MethodPost == r.Method && "reprocess" == action {
+		s.handleReprocess(w, r, id)
+		return
+	}
+	if http.MethodGet != r.Method || "" != action {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.w.mu.RLock()
+	grp, ok := s.w.found[id]
+	s.w.mu.RUnlock()
+	if ok {
+		writeJSON(w, grp)
+		return
+	}
+	// A granule completed in a previous process lifetime is never inserted
+	// into w.found after restart (consider() returns before touching it),
+	// so it would otherwise 404 here even though StateStore still has a
+	// record of it. Fall back to that record instead.
+	if nil != s.w.state {
+		if gs, found := s.w.state.Get(id); found {
+			writeJSON(w, gs)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *Server) handleReprocess(w http.ResponseWriter, r *http.Request, id string) {
+	s.w.mu.Lock()
+	grp, ok := s.w.found[id]
+	if ok {
+		s.w.reprocess[id] = true
+	}
+	s.w.mu.Unlock()
+
+	if ok {
+		if nil != s.w.state {
+			s.w.state.Reprocess(id)
+		}
+		s.w.enqueue(grp)
+		writeJSON(w, map[string]string{"status": "queued", "id": id})
+		return
+	}
+
+	// Same restart gap as handleGroup: a previously-completed granule isn't
+	// in w.found, so there's no FileGroup to enqueue yet. Flag it in both
+	// w.reprocess and the journal and let the next sweep/fsnotify event pick
+	// it back up through the normal consider() path, rather than 404ing.
+	if nil == s.w.state {
+		http.NotFound(w, r)
+		return
+	}
+	if _, found := s.w.state.Get(id); !found {
+		http.NotFound(w, r)
+		return
+	}
+	s.w.mu.Lock()
+	s.w.reprocess[id] = true
+	s.w.mu.Unlock()
+	s.w.state.Reprocess(id)
+	writeJSON(w, map[string]string{"status": "pending-rediscovery", "id": id})
+}
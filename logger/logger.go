@@ -0,0 +1,199 @@
+// Package logger provides a small leveled logging facade on top of the
+// stdlib log.Logger, with per-subsystem debug toggles modeled on
+// Syncthing's STTRACE environment variable and an optional JSON output
+// format for shipping to log aggregators.
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel parses one of debug|info|warn|error, defaulting to LevelInfo
+// on an unrecognized or empty string.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("logger: unknown level %q", s)
+	}
+}
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	mu     sync.Mutex
+	level  = LevelInfo
+	format = FormatText
+	traced = parseTrace(os.Getenv("VIIRS_TRACE"))
+	std    = log.New(os.Stderr, "", log.LstdFlags)
+)
+
+// parseTrace turns a comma separated VIIRS_TRACE value (e.g.
+// "watcher,pipeline,h5dump") into a lookup set of subsystems that should
+// log at debug level regardless of the configured LogLevel.
+func parseTrace(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if "" != part {
+			set[part] = true
+		}
+	}
+	return set
+}
+
+// SetLevel sets the process-wide minimum level for subsystems not listed
+// in VIIRS_TRACE.
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+}
+
+// SetFormat selects text or json output. An unknown format is left
+// unchanged and returns an error.
+func SetFormat(f string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	switch f {
+	case FormatText, FormatJSON:
+		format = f
+		return nil
+	default:
+		return fmt.Errorf("logger: unknown format %q", f)
+	}
+}
+
+// Logger is a per-subsystem facade; granule Id and pipeline Step are
+// attached via With and carried into every record until overwritten.
+type Logger struct {
+	subsystem string
+	id        string
+	step      string
+}
+
+// New returns a Logger for the given subsystem, e.g. "watcher" or
+// "pipeline". The subsystem name is what VIIRS_TRACE matches against.
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// With returns a derived Logger that tags subsequent records with the
+// given granule id and/or pipeline step name. Either may be left empty.
+func (l *Logger) With(id, step string) *Logger {
+	n := *l
+	n.id = id
+	n.step = step
+	return &n
+}
+
+func (l *Logger) enabled(lv Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if traced[l.subsystem] {
+		return true
+	}
+	return lv >= level
+}
+
+type record struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Subsystem string `json:"subsystem"`
+	Id        string `json:"id,omitempty"`
+	Step      string `json:"step,omitempty"`
+	Message   string `json:"message"`
+}
+
+func (l *Logger) log(lv Level, msg string) {
+	if !l.enabled(lv) {
+		return
+	}
+	mu.Lock()
+	f := format
+	mu.Unlock()
+	if FormatJSON == f {
+		rec := record{
+			Time:      time.Now().Format(time.RFC3339),
+			Level:     lv.String(),
+			Subsystem: l.subsystem,
+			Id:        l.id,
+			Step:      l.step,
+			Message:   msg,
+		}
+		b, err := json.Marshal(rec)
+		if nil != err {
+			std.Printf("ERROR: failed to marshal log record: %s\n", err.Error())
+			return
+		}
+		std.Println(string(b))
+		return
+	}
+	tag := strings.ToUpper(lv.String())
+	prefix := fmt.Sprintf("%s: [%s]", tag, l.subsystem)
+	if "" != l.id {
+		prefix += fmt.Sprintf(" id=%s", l.id)
+	}
+	if "" != l.step {
+		prefix += fmt.Sprintf(" step=%s", l.step)
+	}
+	std.Printf("%s %s\n", prefix, msg)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, fmt.Sprintf(format, args...))
+}
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, fmt.Sprintf(format, args...))
+}
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Debugln(args ...interface{}) { l.log(LevelDebug, fmt.Sprintln(args...)) }
+func (l *Logger) Infoln(args ...interface{})  { l.log(LevelInfo, fmt.Sprintln(args...)) }
+func (l *Logger) Warnln(args ...interface{})  { l.log(LevelWarn, fmt.Sprintln(args...)) }
+func (l *Logger) Errorln(args ...interface{}) { l.log(LevelError, fmt.Sprintln(args...)) }
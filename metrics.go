@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics accumulates counters and per-step timing for the Prometheus
+// /metrics endpoint. All fields are safe for concurrent use.
+type Metrics struct {
+	GroupsDiscovered atomic.Uint64
+	GroupsProcessed  atomic.Uint64
+	GroupsFailed     atomic.Uint64
+	H5DumpFailures   atomic.Uint64
+
+	stepMu    sync.Mutex
+	stepSum   map[string]time.Duration
+	stepCount map[string]uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		stepSum:   make(map[string]time.Duration),
+		stepCount: make(map[string]uint64),
+	}
+}
+
+// globalMetrics lets free functions outside the Watcher (e.g. hasNight)
+// record process-wide counters; it is created at package initialisation and
+// every Watcher built by NewWatcher shares it.
+var globalMetrics = NewMetrics()
+
+// ObserveStep records one completed execution of the named pipeline step.
+func (m *Metrics) ObserveStep(step string, dur time.Duration) {
+	m.stepMu.Lock()
+	defer m.stepMu.Unlock()
+	m.stepSum[step] += dur
+	m.stepCount[step]++
+}
+
+// WriteProm renders the metrics in Prometheus text exposition format.
+func (m *Metrics) WriteProm(w io.Writer, queueDepth int) {
+	fmt.Fprintf(w, "# HELP viirs_groups_discovered_total FileGroups discovered since start.\n")
+	fmt.Fprintf(w, "# TYPE viirs_groups_discovered_total counter\n")
+	fmt.Fprintf(w, "viirs_groups_discovered_total %d\n", m.GroupsDiscovered.Load())
+
+	fmt.Fprintf(w, "# HELP viirs_groups_processed_total FileGroups whose pipeline completed successfully.\n")
+	fmt.Fprintf(w, "# TYPE viirs_groups_processed_total counter\n")
+	fmt.Fprintf(w, "viirs_groups_processed_total %d\n", m.GroupsProcessed.Load())
+
+	fmt.Fprintf(w, "# HELP viirs_groups_failed_total FileGroups whose pipeline returned an error.\n")
+	fmt.Fprintf(w, "# TYPE viirs_groups_failed_total counter\n")
+	fmt.Fprintf(w, "viirs_groups_failed_total %d\n", m.GroupsFailed.Load())
+
+	fmt.Fprintf(w, "# HELP viirs_h5dump_failures_total h5dump invocations that failed or produced unparsable output.\n")
+	fmt.Fprintf(w, "# TYPE viirs_h5dump_failures_total counter\n")
+	fmt.Fprintf(w, "viirs_h5dump_failures_total %d\n", m.H5DumpFailures.Load())
+
+	fmt.Fprintf(w, "# HELP viirs_queue_depth Ready FileGroups currently waiting for a worker.\n")
+	fmt.Fprintf(w, "# TYPE viirs_queue_depth gauge\n")
+	fmt.Fprintf(w, "viirs_queue_depth %d\n", queueDepth)
+
+	m.stepMu.Lock()
+	defer m.stepMu.Unlock()
+	fmt.Fprintf(w, "# HELP viirs_step_duration_seconds_sum Cumulative wall-clock time spent in each pipeline step.\n")
+	fmt.Fprintf(w, "# TYPE viirs_step_duration_seconds_sum counter\n")
+	for step, sum := range m.stepSum {
+		fmt.Fprintf(w, "viirs_step_duration_seconds_sum{step=%q} %f\n", step, sum.Seconds())
+	}
+	fmt.Fprintf(w, "# HELP viirs_step_duration_seconds_count Number of times each pipeline step has run.\n")
+	fmt.Fprintf(w, "# TYPE viirs_step_duration_seconds_count counter\n")
+	for step, count := range m.stepCount {
+		fmt.Fprintf(w, "viirs_step_duration_seconds_count{step=%q} %d\n", step, count)
+	}
+}
@@ -1,22 +1,35 @@
 package pipeline
 
 import (
+	l "../logger"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	y "gopkg.in/yaml.v2"
 	"io"
-	"log"
+	"os"
 	"os/exec"
+	fp "path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	tt "text/template"
+	"time"
 )
 
+var log = l.New("pipeline")
+
 const lDelim = "(("
 const rDelim = "))"
 
 var NotAString = errors.New("Variable name not a string.")
 
+// Funcs is merged into every step's Command and When templates, letting the
+// embedding program expose domain-specific predicates (e.g. a hasNight
+// check) without this package depending on that program's packages.
+var Funcs = tt.FuncMap{}
+
 type Variable struct {
 	Name       string      `yaml:"Name"`
 	Value      interface{} `yaml:"Value"`
@@ -50,7 +63,7 @@ func (v *Variable) Prepare() error {
 	if !ok {
 		return nil
 	}
-	t, err := tt.New(v.Name).Delims(lDelim, rDelim).Parse(val)
+	t, err := tt.New(v.Name).Delims(lDelim, rDelim).Funcs(Funcs).Parse(val)
 	if nil != err {
 		return err
 	}
@@ -79,10 +92,32 @@ func (v *Variable) Eval(ctx map[string]interface{}) (interface{}, error) {
 
 /* Step variables may overwrite Pipeline variables */
 type Step struct {
-	Name      string    `yaml:"Name"`
-	Variables Variables `yaml:"Variables"`
-	Command   string    `yaml:"Command"`
-	command   *tt.Template
+	Name        string    `yaml:"Name"`
+	Variables   Variables `yaml:"Variables"`
+	Command     string    `yaml:"Command"`
+	ExecTimeout string    `yaml:"ExecTimeout"`
+	// Inputs/Outputs name context variables, not files: Prepare matches a
+	// step's Inputs against every other step's Outputs to build the
+	// pipeline's dependency DAG. A step with no Inputs opts out of DAG
+	// scheduling and instead implicitly depends on the step before it,
+	// preserving top-to-bottom execution order for unannotated configs.
+	Inputs  []string `yaml:"Inputs"`
+	Outputs []string `yaml:"Outputs"`
+	// When is evaluated like Command; a falsy result skips the step
+	// without failing anything that depends on it.
+	When string `yaml:"When"`
+	// Retries is the number of additional attempts after a failing one;
+	// RetryBackoff is doubled after each attempt up to a fixed cap.
+	// RetryOn restricts retrying to the listed exit codes; left empty, any
+	// nonzero exit is retryable. An error starting the command at all (as
+	// opposed to it running and exiting nonzero) is never retried.
+	Retries      int    `yaml:"Retries"`
+	RetryBackoff string `yaml:"RetryBackoff"`
+	RetryOn      []int  `yaml:"RetryOn"`
+	command      *tt.Template
+	when         *tt.Template
+	execTimeout  time.Duration
+	retryBackoff time.Duration
 }
 
 func (s *Step) UnmarshalYAML(f func(interface{}) error) error {
@@ -100,14 +135,55 @@ func (s *Step) Prepare() error {
 			return err
 		}
 	}
-	c, err := tt.New(s.Name).Delims(lDelim, rDelim).Parse(s.Command)
+	c, err := tt.New(s.Name).Delims(lDelim, rDelim).Funcs(Funcs).Parse(s.Command)
 	if nil != err {
 		return err
 	}
 	s.command = c
+	if "" != s.ExecTimeout {
+		d, err := time.ParseDuration(s.ExecTimeout)
+		if nil != err {
+			return err
+		}
+		s.execTimeout = d
+	}
+	if "" != s.When {
+		w, err := tt.New(s.Name+".When").Delims(lDelim, rDelim).Funcs(Funcs).Parse(s.When)
+		if nil != err {
+			return err
+		}
+		s.when = w
+	}
+	if "" != s.RetryBackoff {
+		d, err := time.ParseDuration(s.RetryBackoff)
+		if nil != err {
+			return err
+		}
+		s.retryBackoff = d
+	}
 	return nil
 }
 
+// ShouldRun evaluates the When template (if any) against ctx. A step with
+// no When always runs; an empty or false-parsing result skips it.
+func (s *Step) ShouldRun(ctx map[string]interface{}) (bool, error) {
+	if nil == s.when {
+		return true, nil
+	}
+	var bb bytes.Buffer
+	if err := s.when.Execute(&bb, ctx); nil != err {
+		return false, err
+	}
+	str := strings.TrimSpace(bb.String())
+	if "" == str {
+		return false, nil
+	}
+	if b, err := strconv.ParseBool(str); nil == err {
+		return b, nil
+	}
+	return true, nil
+}
+
 func (s *Step) EvalVariables(ctx map[string]interface{}) (map[string]interface{}, error) {
 	nctx := make(map[string]interface{})
 	for k, v := range ctx {
@@ -126,14 +202,129 @@ func (s *Step) EvalVariables(ctx map[string]interface{}) (map[string]interface{}
 	return nctx, nil
 }
 
-func (s *Step) Exec(ctx map[string]interface{}) (error, string) {
+// maxRetryBackoff caps the doubling backoff between retry attempts.
+const maxRetryBackoff = 5 * time.Minute
+
+// retryBackoffFor returns the delay before the given retry attempt (1-based),
+// doubling base each time up to maxRetryBackoff.
+func retryBackoffFor(base time.Duration, attempt int) time.Duration {
+	if 0 == base {
+		return 0
+	}
+	d := base
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d > maxRetryBackoff {
+			return maxRetryBackoff
+		}
+	}
+	if d > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return d
+}
+
+// retryable reports whether err, returned by runCommand, is worth another
+// attempt: only a process that actually ran and exited nonzero qualifies,
+// and then only if codes is empty or contains its exit code.
+func retryable(err error, codes []int) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	if 0 == len(codes) {
+		return true
+	}
+	for _, c := range codes {
+		if c == exitErr.ExitCode() {
+			return true
+		}
+	}
+	return false
+}
+
+// syncWriter serializes writes from the concurrent stdout/stderr copiers in
+// runCommand, since neither bytes.Buffer nor *os.File is safe for that on
+// its own.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// runCommand runs cmd/args to completion, capturing stdout and stderr
+// verbatim (merged, in whatever order the OS delivers them) both into the
+// returned string and, if logPath is non-empty, into that file. Attempt 0
+// truncates logPath and later attempts append to it, so a retried step's log
+// keeps every attempt's output rather than only the last one.
+func runCommand(cctx context.Context, cmd string, args []string, logPath string, attempt int) (string, error) {
+	var buf bytes.Buffer
+	dest := io.Writer(&buf)
+	if "" != logPath {
+		// Attempt 0 starts the file fresh (a new Step.Exec call, e.g. a
+		// later DAG run or a resumed pipeline, shouldn't keep appending to a
+		// prior invocation's log forever); later attempts within the same
+		// Step.Exec call append, so a retried step keeps every attempt's
+		// output instead of only the last one.
+		flags := os.O_CREATE | os.O_WRONLY
+		if 0 == attempt {
+			flags |= os.O_TRUNC
+		} else {
+			flags |= os.O_APPEND
+		}
+		if err := os.MkdirAll(fp.Dir(logPath), 0755); nil != err {
+			log.Warnf("Failed to create log directory for %s: %s", logPath, err.Error())
+		} else if f, err := os.OpenFile(logPath, flags, 0644); nil == err {
+			defer f.Close()
+			fmt.Fprintf(f, "----- attempt %d -----\n", attempt+1)
+			dest = io.MultiWriter(&buf, f)
+		} else {
+			log.Warnf("Failed to create step log %s: %s", logPath, err.Error())
+		}
+	}
+	out := &syncWriter{w: dest}
+
+	c := exec.CommandContext(cctx, cmd, args...)
+	stdout, err := c.StdoutPipe()
+	if nil != err {
+		return "", err
+	}
+	stderr, err := c.StderrPipe()
+	if nil != err {
+		return "", err
+	}
+	if err := c.Start(); nil != err {
+		return "", err
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); io.Copy(out, stdout) }()
+	go func() { defer wg.Done(); io.Copy(out, stderr) }()
+	wg.Wait()
+
+	return buf.String(), c.Wait()
+}
+
+// Exec evaluates the step's Variables against ctx and runs Command,
+// returning the evaluated local context alongside the usual error/output
+// pair so a DAG-driven caller can pick the step's declared Outputs back
+// out of it. A failing run is retried up to Retries times with doubling
+// RetryBackoff, and the full captured stdout+stderr of every attempt is
+// persisted to <OutputDir>/<Id>/<Name>.log when those context variables are
+// set.
+func (s *Step) Exec(ctx map[string]interface{}) (map[string]interface{}, error, string) {
 	nctx, err := s.EvalVariables(ctx)
 	if nil != err {
-		return err, ""
+		return nctx, err, ""
 	}
 	var buf bytes.Buffer
 	if err = s.command.Execute(&buf, nctx); nil != err {
-		return err, ""
+		return nctx, err, ""
 	}
 	var r rune
 	var acc bytes.Buffer
@@ -188,7 +379,7 @@ func (s *Step) Exec(ctx map[string]interface{}) (error, string) {
 		}
 	}
 	if io.EOF != err {
-		return err, ""
+		return nctx, err, ""
 	} else {
 		wrap()
 	}
@@ -198,19 +389,53 @@ func (s *Step) Exec(ctx map[string]interface{}) (error, string) {
 		cmd = split[0]
 		args = split[1:]
 	}
-	log.Printf("DEBUG: Invoking command %s with arguments %v\n", cmd, args)
-	out, err := exec.Command(cmd, args...).Output()
-	var res = string(out)
-	if err, ok := err.(*exec.ExitError); ok {
-		res = fmt.Sprintf("%s\n%s", res, err.Stderr)
+	log.Debugf("Invoking command %s with arguments %v", cmd, args)
+
+	var logPath string
+	if id, ok := nctx["Id"].(string); ok && "" != id {
+		if outDir, ok := nctx["OutputDir"].(string); ok && "" != outDir {
+			logPath = fp.Join(outDir, id, s.Name+".log")
+		}
+	}
+
+	var res string
+	for attempt := 0; ; attempt++ {
+		var cctx = context.Background()
+		var cancel context.CancelFunc
+		if 0 != s.execTimeout {
+			cctx, cancel = context.WithTimeout(cctx, s.execTimeout)
+		}
+		res, err = runCommand(cctx, cmd, args, logPath, attempt)
+		if context.DeadlineExceeded == cctx.Err() {
+			log.Warnf("Command %s timed out after %s", cmd, s.execTimeout)
+			err = cctx.Err()
+		}
+		if nil != cancel {
+			cancel()
+		}
+		if nil == err || attempt >= s.Retries || !retryable(err, s.RetryOn) {
+			break
+		}
+		backoff := retryBackoffFor(s.retryBackoff, attempt+1)
+		log.Warnf("Step %s attempt %d failed (%s), retrying in %s", s.Name, attempt+1, err.Error(), backoff)
+		if 0 != backoff {
+			time.Sleep(backoff)
+		}
 	}
-	return err, res
+	return nctx, err, res
 }
 
 /* Apart from variables defined, there is also globaly available Id variable */
 type Pipeline struct {
-	Variables Variables `yaml:"Variables"`
-	Steps     []Step    `yaml:"Steps"`
+	Variables        Variables `yaml:"Variables"`
+	Steps            []Step    `yaml:"Steps"`
+	MaxParallelSteps int       `yaml:"MaxParallelSteps"`
+
+	// deps[i]/dependents[i] hold step indices, built by Prepare from Inputs
+	// matched against other steps' Outputs: deps[i] is what i waits on,
+	// dependents[i] is what waits on i.
+	deps       [][]int
+	dependents [][]int
 }
 
 func (p *Pipeline) Prepare() error {
@@ -224,6 +449,78 @@ func (p *Pipeline) Prepare() error {
 			return err
 		}
 	}
+	if 0 >= p.MaxParallelSteps {
+		p.MaxParallelSteps = len(p.Steps)
+	}
+	return p.buildDAG()
+}
+
+// buildDAG matches each step's Inputs against every other step's Outputs to
+// derive the pipeline's dependency graph, then runs Kahn's algorithm purely
+// to detect cycles up front; Exec walks the same graph concurrently.
+//
+// A step that declares no Inputs hasn't opted into the DAG semantics Inputs
+// and Outputs exist to express, so it falls back to an implicit dependency
+// on the step immediately before it. Without this, an unmodified pipeline
+// config (every Step's Inputs/Outputs left unset, as with the "linear
+// detect->fit chain" this feature shipped alongside) would have every step
+// at indegree zero and all run concurrently from the first instant, silently
+// turning the old strictly-sequential behaviour into an unordered race.
+func (p *Pipeline) buildDAG() error {
+	n := len(p.Steps)
+	p.deps = make([][]int, n)
+	p.dependents = make([][]int, n)
+	for i := range p.Steps {
+		for _, in := range p.Steps[i].Inputs {
+			for j := range p.Steps {
+				if j == i {
+					continue
+				}
+				for _, out := range p.Steps[j].Outputs {
+					if out == in {
+						p.deps[i] = append(p.deps[i], j)
+						p.dependents[j] = append(p.dependents[j], i)
+					}
+				}
+			}
+		}
+		if 0 == len(p.Steps[i].Inputs) && i > 0 {
+			p.deps[i] = append(p.deps[i], i-1)
+			p.dependents[i-1] = append(p.dependents[i-1], i)
+		}
+	}
+
+	indeg := make([]int, n)
+	for i := range p.deps {
+		indeg[i] = len(p.deps[i])
+	}
+	queue := make([]int, 0, n)
+	for i, d := range indeg {
+		if 0 == d {
+			queue = append(queue, i)
+		}
+	}
+	visited := 0
+	for 0 != len(queue) {
+		i := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, j := range p.dependents[i] {
+			indeg[j]--
+			if 0 == indeg[j] {
+				queue = append(queue, j)
+			}
+		}
+	}
+	if visited != n {
+		var stuck []string
+		for i, d := range indeg {
+			if d > 0 {
+				stuck = append(stuck, p.Steps[i].Name)
+			}
+		}
+		return fmt.Errorf("pipeline has a dependency cycle involving steps: %s", strings.Join(stuck, ", "))
+	}
 	return nil
 }
 
@@ -238,15 +535,144 @@ func (p *Pipeline) EvalVariables(ctx map[string]interface{}) (map[string]interfa
 	return ctx, nil
 }
 
-func (p *Pipeline) Exec(ctx map[string]interface{}) (error, string) {
-	var vars, err = p.EvalVariables(ctx)
+// Exec runs the pipeline's steps concurrently, bounded by MaxParallelSteps,
+// scheduling each step as soon as every step it depends on (per Inputs
+// matched against Outputs) has finished or been skipped by its When clause.
+// done holds the indices of steps a prior run already completed
+// successfully (nil or empty means run everything); those steps are skipped
+// and contribute no Outputs, matching the resume behaviour from before the
+// pipeline became a DAG, except generalized from a single "steps below here
+// are done" watermark to an arbitrary set, since concurrent steps can
+// complete out of index order. onStep is invoked once per step that executes
+// successfully, with its index and wall-clock duration, so a caller can persist
+// resume progress and report per-step timing. onStep may be nil.
+func (p *Pipeline) Exec(ctx map[string]interface{}, done map[int]bool, onStep func(int, time.Duration)) (error, string) {
+	vars, err := p.EvalVariables(ctx)
 	if nil != err {
 		return err, ""
 	}
-	for s := range p.Steps {
-		if err, str := p.Steps[s].Exec(vars); nil != err {
-			return err, str
+
+	n := len(p.Steps)
+
+	skip := make([]bool, n)
+	for i := range skip {
+		skip[i] = done[i]
+	}
+	// A skipped step contributes no Outputs to vars, since it never runs
+	// this time. If a skipped step itself depends on a step that is not
+	// skipped (so it will actually run and may produce different Outputs),
+	// trusting the skip would feed the skipped step's dependents a missing
+	// or stale context variable instead of the real value. Invalidate such
+	// steps and let them re-run; repeat until the set of skips stops
+	// shrinking, since invalidating one step can in turn invalidate ones
+	// that depend on it.
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < n; i++ {
+			if !skip[i] {
+				continue
+			}
+			for _, j := range p.deps[i] {
+				if !skip[j] {
+					log.Warnf("Step %s was marked done by a prior run but depends on step %s which is not; re-running %s instead of trusting stale resume state", p.Steps[i].Name, p.Steps[j].Name, p.Steps[i].Name)
+					skip[i] = false
+					changed = true
+					break
+				}
+			}
 		}
 	}
-	return nil, ""
+
+	indeg := make([]int, n)
+	for i := range p.deps {
+		indeg[i] = len(p.deps[i])
+	}
+
+	var mu sync.Mutex // guards vars, failErr/failOut and indeg
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, p.MaxParallelSteps)
+
+	var failErr error
+	var failOut string
+
+	var run func(i int)
+	run = func(i int) {
+		defer wg.Done()
+		sem <- struct{}{}
+		defer func() { <-sem }()
+
+		mu.Lock()
+		failed := nil != failErr
+		localCtx := make(map[string]interface{}, len(vars))
+		for k, v := range vars {
+			localCtx[k] = v
+		}
+		mu.Unlock()
+
+		if !failed && !skip[i] {
+			if ok, err := p.Steps[i].ShouldRun(localCtx); nil != err {
+				mu.Lock()
+				if nil == failErr {
+					failErr, failOut = err, ""
+				}
+				mu.Unlock()
+			} else if !ok {
+				log.Infof("Step %s skipped, When evaluated false", p.Steps[i].Name)
+			} else {
+				t0 := time.Now()
+				if nctx, err, out := p.Steps[i].Exec(localCtx); nil != err {
+					mu.Lock()
+					if nil == failErr {
+						failErr, failOut = err, out
+					}
+					mu.Unlock()
+				} else {
+					mu.Lock()
+					for _, name := range p.Steps[i].Outputs {
+						if v, ok := nctx[name]; ok {
+							vars[name] = v
+						}
+					}
+					mu.Unlock()
+					if nil != onStep {
+						onStep(i, time.Since(t0))
+					}
+				}
+			}
+		}
+
+		mu.Lock()
+		var unblocked []int
+		for _, j := range p.dependents[i] {
+			indeg[j]--
+			if 0 == indeg[j] {
+				unblocked = append(unblocked, j)
+			}
+		}
+		mu.Unlock()
+		for _, j := range unblocked {
+			wg.Add(1)
+			go run(j)
+		}
+	}
+
+	// Collect every root (zero-indegree) step before spawning any goroutine:
+	// once run(i) starts, it mutates indeg for its dependents under mu, so
+	// reading indeg here while goroutines are already running would race
+	// with those writes and could dispatch the same step twice - once from
+	// this scan observing a stale zero and once from its legitimate
+	// unblocking dependency.
+	var roots []int
+	for i := 0; i < n; i++ {
+		if 0 == indeg[i] {
+			roots = append(roots, i)
+		}
+	}
+	for _, i := range roots {
+		wg.Add(1)
+		go run(i)
+	}
+	wg.Wait()
+
+	return failErr, failOut
 }
@@ -0,0 +1,195 @@
+package pipeline
+
+import (
+	"os"
+	fp "path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBuildDAGImplicitSequential checks that steps declaring no Inputs fall
+// back to depending on the step immediately before them, so an unannotated
+// pipeline config stays strictly sequential instead of every step racing
+// from indegree zero.
+func TestBuildDAGImplicitSequential(t *testing.T) {
+	p := &Pipeline{Steps: []Step{
+		{Name: "a", Command: "true"},
+		{Name: "b", Command: "true"},
+		{Name: "c", Command: "true"},
+	}}
+	if err := p.Prepare(); nil != err {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if !reflect.DeepEqual(p.deps[0], []int(nil)) {
+		t.Fatalf("step 0 should have no deps, got %v", p.deps[0])
+	}
+	if !reflect.DeepEqual(p.deps[1], []int{0}) {
+		t.Fatalf("step 1 should implicitly depend on step 0, got %v", p.deps[1])
+	}
+	if !reflect.DeepEqual(p.deps[2], []int{1}) {
+		t.Fatalf("step 2 should implicitly depend on step 1, got %v", p.deps[2])
+	}
+}
+
+// TestBuildDAGExplicitInputsOverrideImplicitEdge checks that a step
+// declaring Inputs opts out of the implicit i-1 edge entirely, even when the
+// matched Outputs come from a step further back than its immediate
+// predecessor.
+func TestBuildDAGExplicitInputsOverrideImplicitEdge(t *testing.T) {
+	p := &Pipeline{Steps: []Step{
+		{Name: "produce", Command: "true", Outputs: []string{"X"}},
+		{Name: "unrelated", Command: "true"},
+		{Name: "consume", Command: "true", Inputs: []string{"X"}},
+	}}
+	if err := p.Prepare(); nil != err {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if !reflect.DeepEqual(p.deps[2], []int{0}) {
+		t.Fatalf("step 2 should depend only on step 0 via Inputs/Outputs, got %v", p.deps[2])
+	}
+}
+
+// TestExecResumeInvalidatesStaleDone checks that a step marked done by a
+// prior run is re-run anyway if a step it depends on is not marked done,
+// since that dependency's Outputs are otherwise missing from this run's
+// context (the chunk0-4 bug this guards against).
+func TestExecResumeInvalidatesStaleDone(t *testing.T) {
+	p := &Pipeline{Steps: []Step{
+		{Name: "produce", Command: "true", Outputs: []string{"X"}},
+		{Name: "consume", Command: "true", Inputs: []string{"X"}},
+	}}
+	if err := p.Prepare(); nil != err {
+		t.Fatalf("Prepare: %v", err)
+	}
+
+	var mu sync.Mutex
+	var ran []int
+	onStep := func(i int, _ time.Duration) {
+		mu.Lock()
+		ran = append(ran, i)
+		mu.Unlock()
+	}
+
+	// consume is falsely marked done while produce, which it depends on, is
+	// not: both must run rather than trusting the stale "done" for consume.
+	done := map[int]bool{1: true}
+	if err, out := p.Exec(map[string]interface{}{}, done, onStep); nil != err {
+		t.Fatalf("Exec: %v (%s)", err, out)
+	}
+	sort.Ints(ran)
+	if !reflect.DeepEqual(ran, []int{0, 1}) {
+		t.Fatalf("expected both steps to run, got %v", ran)
+	}
+}
+
+// TestExecResumeSkipsSatisfiedDone checks the ordinary resume path: a done
+// step whose own dependencies are all also done is skipped.
+func TestExecResumeSkipsSatisfiedDone(t *testing.T) {
+	p := &Pipeline{Steps: []Step{
+		{Name: "produce", Command: "true", Outputs: []string{"X"}},
+		{Name: "consume", Command: "true", Inputs: []string{"X"}},
+	}}
+	if err := p.Prepare(); nil != err {
+		t.Fatalf("Prepare: %v", err)
+	}
+
+	var mu sync.Mutex
+	var ran []int
+	onStep := func(i int, _ time.Duration) {
+		mu.Lock()
+		ran = append(ran, i)
+		mu.Unlock()
+	}
+
+	done := map[int]bool{0: true}
+	if err, out := p.Exec(map[string]interface{}{}, done, onStep); nil != err {
+		t.Fatalf("Exec: %v (%s)", err, out)
+	}
+	if !reflect.DeepEqual(ran, []int{1}) {
+		t.Fatalf("expected only step 1 to run, got %v", ran)
+	}
+}
+
+// TestExecDiamondDAGRunsEachStepOnce exercises a diamond dependency graph
+// (two steps unblocked concurrently by the same root, both feeding a single
+// step further down) with no resume state at all, so root dispatch and
+// dependent unblocking race freely. Run with -race, this catches the
+// chunk0-6 bug where scanning indeg for roots concurrently with goroutines
+// already decrementing it could dispatch the same step twice.
+func TestExecDiamondDAGRunsEachStepOnce(t *testing.T) {
+	p := &Pipeline{Steps: []Step{
+		{Name: "root", Command: "true", Outputs: []string{"X"}},
+		{Name: "left", Command: "true", Inputs: []string{"X"}, Outputs: []string{"L"}},
+		{Name: "right", Command: "true", Inputs: []string{"X"}, Outputs: []string{"R"}},
+		{Name: "join", Command: "true", Inputs: []string{"L", "R"}},
+	}}
+	if err := p.Prepare(); nil != err {
+		t.Fatalf("Prepare: %v", err)
+	}
+
+	var mu sync.Mutex
+	counts := make(map[int]int)
+	onStep := func(i int, _ time.Duration) {
+		mu.Lock()
+		counts[i]++
+		mu.Unlock()
+	}
+
+	if err, out := p.Exec(map[string]interface{}{}, nil, onStep); nil != err {
+		t.Fatalf("Exec: %v (%s)", err, out)
+	}
+	for i := 0; i < len(p.Steps); i++ {
+		if 1 != counts[i] {
+			t.Errorf("step %d (%s) ran %d times, want exactly 1", i, p.Steps[i].Name, counts[i])
+		}
+	}
+}
+
+// TestRetryBackoffFor checks the doubling-with-cap arithmetic: attempt 1
+// waits base, each subsequent attempt doubles, and the result never exceeds
+// maxRetryBackoff however many attempts are requested.
+func TestRetryBackoffFor(t *testing.T) {
+	base := 10 * time.Second
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{10, maxRetryBackoff},
+	}
+	for _, c := range cases {
+		if got := retryBackoffFor(base, c.attempt); got != c.want {
+			t.Errorf("retryBackoffFor(%s, %d) = %s, want %s", base, c.attempt, got, c.want)
+		}
+	}
+	if got := retryBackoffFor(0, 5); 0 != got {
+		t.Errorf("retryBackoffFor(0, 5) = %s, want 0", got)
+	}
+}
+
+// TestStepExecRetryAppendsLog checks that a retried step's log file keeps
+// every attempt's output rather than only the last one overwriting the rest.
+func TestStepExecRetryAppendsLog(t *testing.T) {
+	outDir := t.TempDir()
+	s := Step{Name: "flaky", Command: "false", Retries: 1}
+	if err := s.Prepare(); nil != err {
+		t.Fatalf("Prepare: %v", err)
+	}
+	ctx := map[string]interface{}{"Id": "G1", "OutputDir": outDir}
+	s.Exec(ctx)
+
+	b, err := os.ReadFile(fp.Join(outDir, "G1", "flaky.log"))
+	if nil != err {
+		t.Fatalf("reading step log: %v", err)
+	}
+	log := string(b)
+	if 2 != strings.Count(log, "----- attempt") {
+		t.Fatalf("expected both attempts preserved in the log, got: %q", log)
+	}
+}
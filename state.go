@@ -0,0 +1,169 @@
+package main
+
+import (
+	l "./logger"
+	"encoding/json"
+	"os"
+	fp "path/filepath"
+	"sync"
+	"time"
+)
+
+var stateLog = l.New("state")
+
+// FileState is the persisted size/mtime snapshot for a single tracked file.
+type FileState struct {
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// GroupState is the persisted record for one FileGroup, surviving restarts
+// so a crash mid-pipeline can resume without re-running earlier expensive
+// steps.
+//
+// StepsDone is keyed by pipeline step index rather than holding a single
+// highest-index watermark: since chunk0-6 steps can finish out of index
+// order (a fast, dependency-free step can complete before slower earlier
+// steps even start), a "highest index seen" watermark could claim a step
+// done when it never ran. Pipeline.Exec re-derives, from this set, which
+// steps are actually safe to skip on resume.
+type GroupState struct {
+	Id        string               `json:"id"`
+	Files     map[string]FileState `json:"files"`
+	Completed bool                 `json:"completed"`
+	LastRun   time.Time            `json:"last_run,omitempty"`
+	StepsDone map[int]bool         `json:"steps_done"`
+}
+
+type journal struct {
+	Groups map[string]*GroupState `json:"groups"`
+}
+
+// StateStore is a JSON-backed journal of GroupState records rooted at
+// cfg.StateDir. Every mutation is flushed to disk immediately via a
+// write-to-temp-then-rename so a crash never leaves a half-written file.
+type StateStore struct {
+	path string
+	mu   sync.Mutex
+	data journal
+}
+
+func NewStateStore(dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0755); nil != err {
+		return nil, err
+	}
+	s := &StateStore{
+		path: fp.Join(dir, "state.json"),
+		data: journal{Groups: make(map[string]*GroupState)},
+	}
+	if err := s.load(); nil != err {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *StateStore) load() error {
+	b, err := os.ReadFile(s.path)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(b, &s.data); nil != err {
+		return err
+	}
+	if nil == s.data.Groups {
+		s.data.Groups = make(map[string]*GroupState)
+	}
+	return nil
+}
+
+func (s *StateStore) save() error {
+	b, err := json.MarshalIndent(s.data, "", "  ")
+	if nil != err {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); nil != err {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *StateStore) group(id string) *GroupState {
+	gs, ok := s.data.Groups[id]
+	if !ok {
+		gs = &GroupState{Id: id, Files: make(map[string]FileState), StepsDone: make(map[int]bool)}
+		s.data.Groups[id] = gs
+	}
+	return gs
+}
+
+// Get returns the persisted state for id, if any.
+func (s *StateStore) Get(id string) (GroupState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs, ok := s.data.Groups[id]
+	if !ok {
+		return GroupState{}, false
+	}
+	return *gs, true
+}
+
+// Track records the current per-file size/mtime for fg, e.g. once it is
+// found to be ready for processing.
+func (s *StateStore) Track(fg *FileGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs := s.group(fg.Id)
+	for name, f := range fg.Files {
+		gs.Files[name] = FileState{Size: f.Size, LastModified: f.LastModified}
+	}
+	if err := s.save(); nil != err {
+		stateLog.Warnf("Failed to persist state for %s: %s", fg.Id, err.Error())
+	}
+}
+
+// MarkStep records that the pipeline step at index has completed
+// successfully for id, so a crash can resume without re-running it.
+func (s *StateStore) MarkStep(id string, index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs := s.group(id)
+	if nil == gs.StepsDone {
+		gs.StepsDone = make(map[int]bool)
+	}
+	gs.StepsDone[index] = true
+	if err := s.save(); nil != err {
+		stateLog.Warnf("Failed to persist step progress for %s: %s", id, err.Error())
+	}
+}
+
+// MarkCompleted records a fully successful pipeline run for id.
+func (s *StateStore) MarkCompleted(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs := s.group(id)
+	gs.Completed = true
+	gs.LastRun = time.Now()
+	if err := s.save(); nil != err {
+		stateLog.Warnf("Failed to persist completion for %s: %s", id, err.Error())
+	}
+}
+
+// Reprocess clears the completion and step-progress markers for id, forcing
+// the next Process call to run the pipeline from the beginning.
+func (s *StateStore) Reprocess(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs, ok := s.data.Groups[id]
+	if !ok {
+		return
+	}
+	gs.Completed = false
+	gs.StepsDone = make(map[int]bool)
+	if err := s.save(); nil != err {
+		stateLog.Warnf("Failed to persist reprocess request for %s: %s", id, err.Error())
+	}
+}